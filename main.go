@@ -11,26 +11,25 @@
 // When combined with go-import-subtree you can import all packages in the
 // plugins/ folder automatically. Freeing you from maintaining a file importing
 // all your plugins, just run 'go generate'.
-
+//
+// The generation logic itself lives in the subtree package, so it can be
+// reused by other code-generation tools; this command is a thin docopt
+// wrapper around it.
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"go/build"
-	"go/format"
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
-	"path/filepath"
+	"strings"
 
 	"github.com/docopt/docopt-go"
+	"github.com/jonasfj/go-import-subtree/subtree"
 )
 
 const version = "go-import-subtree 1.0.0"
 const usage = `
-Usage: go-import-subtree [options] [--] <folder> [<folder> ...]
+Usage: go-import-subtree [options] [--include=<glob>]... [--exclude=<glob>]... [--] <folder> [<folder> ...]
 
 Creates a go file with side-effect imports for all sub-folders in a folder.
 
@@ -40,73 +39,77 @@ Options:
   -r, --recursive          Import sub-trees recursively.
   -o, --output=<file>      Output file to write import statements to
                            [default: subtree_imports.go].
+  --include=<glob>         Only consider subfolders matching glob, relative
+                           to the folder being scanned. May be given multiple
+                           times. Applied after the built-in skips below.
+  --exclude=<glob>         Skip subfolders matching glob, relative to the
+                           folder being scanned. May be given multiple times.
+                           Takes precedence over --include.
+  --tags=<list>            Comma-separated list of build tags, mirroring
+                           'go build -tags', used when evaluating which
+                           subfolders are platform/tag constrained.
+  --registry=<Type>        Instead of blank imports, generate a
+                           'map[string]<Type>' named after <Type> pluralized,
+                           populated by calling --factory in each subpackage.
+                           <Type> must be declared in the current package.
+                           Requires --factory.
+  --factory=<Name>         Name of the zero-argument function each
+                           subpackage must export to participate in
+                           --registry; its return type must implement <Type>.
+
+vendor, testdata, node_modules and any folder whose name starts with "." or
+"_" are always skipped, matching the go tool's own rules, regardless of
+--include.
+
+Subfolders that only build for a subset of GOOS and/or GOARCH values (e.g. a
+plugin using //go:build windows, or one using //go:build arm64 alone) are
+written to their own "<output>_<goos>_<goarch>.go" file with a matching
+//go:build header, instead of --output, so the generated code never breaks a
+build on a platform the plugin itself doesn't support. A constraint that
+can't be expressed as a simple GOOS/GOARCH combination is approximated and
+logged as such.
 
 Report bugs to https://github.com/jonasfj/go-import-subtree/issues
 `
 
-func renderImports(b *bytes.Buffer, importPath string, folder string, recursive bool) {
-	// List contents of folder
-	entries, err := ioutil.ReadDir(folder)
-	if err != nil {
-		log.Fatalf("Couldn't list contents of folder: %s, error: %s", folder, err)
-	}
-
-	for _, f := range entries {
-		if f.IsDir() {
-			subImportPath := path.Join(importPath, f.Name())
-			log.Println(subImportPath)
-			line := fmt.Sprintf("import _ \"%s\"\n", subImportPath)
-			b.WriteString(line)
-			if recursive {
-				renderImports(b, subImportPath, filepath.Join(folder, f.Name()), recursive)
-			}
-		}
-	}
-}
-
 func main() {
-	log.SetFlags(0)
-	log.SetPrefix("import-subtree: ")
+	logger := log.New(os.Stderr, "import-subtree: ", 0)
 
 	// Parse docopt string
 	args, _ := docopt.Parse(usage, nil, true, version, false, true)
 	outputPath := args["--output"].(string)
-	recursive := args["--recursive"].(bool)
-	folders := args["<folder>"].([]string)
-
-	// Get working directory
-	currentFolder, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("Unable to obtain current working directory: %s", err)
+	registryType, _ := args["--registry"].(string)
+	factoryName, _ := args["--factory"].(string)
+	if registryType != "" && factoryName == "" {
+		logger.Fatalf("--registry requires --factory")
 	}
-
-	// Read current package
-	pkg, err := build.ImportDir(currentFolder, build.AllowBinary)
-	if err != nil {
-		log.Fatalf("Failed to import current package: %s", err)
+	var tags []string
+	if rawTags, _ := args["--tags"].(string); rawTags != "" {
+		tags = strings.Split(rawTags, ",")
 	}
-	log.Printf("Identified current package as: %s", pkg.Name)
-	log.Printf("Determined current import path: %s", pkg.ImportPath)
 
-	// Generate source
-	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("package %s\n", pkg.Name))
-	log.Println("Finding sub-packages to import:")
-	for _, folder := range folders {
-		importPath := path.Join(pkg.ImportPath, folder)
-		folder = filepath.Join(currentFolder, folder)
-		renderImports(&b, importPath, folder, recursive)
+	opts := subtree.Options{
+		Folders:   args["<folder>"].([]string),
+		Recursive: args["--recursive"].(bool),
+		Tags:      tags,
+		Include:   args["--include"].([]string),
+		Exclude:   args["--exclude"].([]string),
+		Registry:  registryType,
+		Factory:   factoryName,
+		Logger:    logger,
 	}
 
-	// Run go.fmt to format source
-	output, err := format.Source(b.Bytes())
+	files, err := subtree.GenerateFiles(opts)
 	if err != nil {
-		log.Fatalf("Failed to format source, internal error: %s", err)
+		logger.Fatal(err)
 	}
 
-	// Write output
-	ioutil.WriteFile(outputPath, output, 0644)
-	if err != nil {
-		log.Fatalf("Failed to write output file %s: %s", outputPath, err)
+	// Write one file per bucket, so a plugin that only builds for one
+	// platform can't break generation for the rest.
+	for _, f := range files {
+		outPath := f.OutputPath(outputPath)
+		if err := ioutil.WriteFile(outPath, f.Source, 0644); err != nil {
+			logger.Fatalf("Failed to write output file %s: %s", outPath, err)
+		}
 	}
 }
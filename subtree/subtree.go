@@ -0,0 +1,716 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package subtree implements the generation logic behind go-import-subtree:
+// given a folder of subpackages (a plugins/ tree, say), it produces the
+// source of one or more Go files that either blank-import every subpackage
+// or, in --registry mode, register each one in a map keyed by folder name.
+//
+// It does its own package resolution and folder walking, but never touches
+// the filesystem to write anything; callers decide what to do with the
+// returned source. The go-import-subtree command is a thin docopt wrapper
+// around this package.
+package subtree
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"go/format"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Options controls a single generation run. It mirrors the go-import-subtree
+// CLI flags.
+type Options struct {
+	// Folders are scanned for subpackages to import/register, relative to
+	// the current working directory. At least one is required.
+	Folders []string
+	// Recursive imports sub-trees recursively, rather than only the
+	// immediate children of each folder.
+	Recursive bool
+	// Tags is a list of build tags, mirroring 'go build -tags', used when
+	// evaluating which subfolders are platform/tag constrained.
+	Tags []string
+	// Include, if non-empty, restricts subfolders to those whose path
+	// relative to the folder being scanned matches at least one glob.
+	// Applied after the built-in vendor/testdata/hidden-folder skips.
+	Include []string
+	// Exclude skips subfolders whose relative path matches a glob. Takes
+	// precedence over Include.
+	Exclude []string
+	// Registry, if non-empty, is the name of an interface type declared in
+	// the current package; instead of blank imports, Generate/GenerateFiles
+	// produce a map[string]Registry variable. Requires Factory.
+	Registry string
+	// Factory is the name of the zero-argument function each subpackage
+	// must export, whose return type must implement Registry, to
+	// participate in --registry mode.
+	Factory string
+	// Output, if non-null, receives a copy of the source Generate returns.
+	// GenerateFiles ignores it; it writes nothing anywhere and leaves all
+	// files for the caller to place.
+	Output io.Writer
+	// Logger receives progress messages (which subfolders were selected,
+	// skipped, or why). Defaults to a logger that discards its output.
+	Logger *log.Logger
+}
+
+func (o Options) logger() *log.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return log.New(ioutil.Discard, "", 0)
+}
+
+// File is one generated output file. Subfolders are bucketed by the GOOS
+// and GOARCH values they're constrained to, so a plugins/ tree containing a
+// plugins/windows package, or a plugins/arm64only package gated purely on
+// //go:build arm64, generates a separate File for it, with its own
+// //go:build header, rather than breaking the build on other platforms.
+type File struct {
+	// Suffix distinguishes this File from the others generated by the same
+	// run, e.g. "_linux" or "_windows_darwin" or "_arm64"; empty for the
+	// unconstrained bucket. OutputPath combines it with a base file name.
+	Suffix string
+	// GOOS is the set of GOOS values this file is constrained to, nil if
+	// it's not GOOS-constrained.
+	GOOS []string
+	// GOARCH is the set of GOARCH values this file is constrained to, nil
+	// if it's not GOARCH-constrained.
+	GOARCH []string
+	// Source is the formatted Go source of this file.
+	Source []byte
+}
+
+// OutputPath derives the path this File should be written to from base,
+// e.g. base="subtree_imports.go" with Suffix="_windows" becomes
+// "subtree_imports_windows.go".
+func (f File) OutputPath(base string) string {
+	if f.Suffix == "" {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + f.Suffix + ext
+}
+
+// Generate runs a single generation pass and returns the formatted source of
+// its unconstrained file, i.e. the one that isn't restricted to a subset of
+// GOOS values. That's almost always what embedders want. If opts.Output is
+// non-nil, the same source is also written there.
+//
+// Folders containing platform-constrained subpackages also produce
+// GOOS-constrained files, which Generate discards; use GenerateFiles to get
+// all of them.
+func Generate(opts Options) ([]byte, error) {
+	files, err := GenerateFiles(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Suffix != "" {
+			continue
+		}
+		if opts.Output != nil {
+			if _, err := opts.Output.Write(f.Source); err != nil {
+				return nil, fmt.Errorf("failed to write to opts.Output: %s", err)
+			}
+		}
+		return f.Source, nil
+	}
+	// GenerateFiles always includes the unconstrained bucket, even if empty.
+	panic("subtree: GenerateFiles did not return an unconstrained file")
+}
+
+// GenerateFiles runs a single generation pass and returns every output file
+// it produces: the unconstrained one (always present, even if it ends up
+// empty) plus one per distinct set of GOOS values a selected subpackage is
+// constrained to. It never touches the filesystem; opts.Output is ignored.
+func GenerateFiles(opts Options) ([]File, error) {
+	logger := opts.logger()
+
+	if opts.Registry != "" && opts.Factory == "" {
+		return nil, fmt.Errorf("Registry requires Factory")
+	}
+	if len(opts.Folders) == 0 {
+		return nil, fmt.Errorf("no folders given")
+	}
+
+	currentFolder, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain current working directory: %s", err)
+	}
+
+	// Determine whether we're operating inside a module, so we know whether
+	// to resolve import paths via golang.org/x/tools/go/packages (module
+	// aware) or fall back to the GOPATH-based go/build resolution.
+	gomod, err := currentGoMod(currentFolder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine module status: %s", err)
+	}
+	useModules := gomod != ""
+
+	// Read current package
+	var pkgName, pkgImportPath string
+	var currentPkg *packages.Package
+	if useModules {
+		var ok bool
+		currentPkg, ok = loadPackage(currentFolder, "", "", opts.Tags)
+		if !ok {
+			return nil, fmt.Errorf("failed to import current package as a module: %s", currentFolder)
+		}
+		pkgName, pkgImportPath = currentPkg.Name, currentPkg.PkgPath
+	} else {
+		pkg, err := build.ImportDir(currentFolder, build.AllowBinary)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import current package: %s", err)
+		}
+		pkgName, pkgImportPath = pkg.Name, pkg.ImportPath
+	}
+	logger.Printf("Identified current package as: %s", pkgName)
+	logger.Printf("Determined current import path: %s", pkgImportPath)
+
+	f := filters{include: opts.Include, exclude: opts.Exclude}
+
+	// Find sub-packages to import, and bucket them by the GOOS/GOARCH values
+	// they're constrained to (nil/unconstrained goes in its own bucket).
+	logger.Println("Finding sub-packages to import:")
+	var found []foundImport
+	for _, folder := range opts.Folders {
+		importPath := path.Join(pkgImportPath, folder)
+		folder = filepath.Join(currentFolder, folder)
+		found = append(found, findImports(importPath, folder, "", opts.Recursive, useModules, f, opts.Tags, logger)...)
+	}
+
+	// Always produce the unconstrained file, even if it ends up empty, so
+	// downstream tooling can rely on it existing.
+	unconstrainedKey := constraint{}.key()
+	buckets := map[string][]foundImport{unconstrainedKey: nil}
+	bucketConstraint := map[string]constraint{unconstrainedKey: {}}
+	for _, imp := range found {
+		key := imp.constraint.key()
+		buckets[key] = append(buckets[key], imp)
+		bucketConstraint[key] = imp.constraint
+	}
+
+	if opts.Registry != "" && currentPkg == nil {
+		return nil, fmt.Errorf("Registry requires running inside a module")
+	}
+
+	if opts.Registry == "" {
+		var files []File
+		for key, imports := range buckets {
+			c := bucketConstraint[key]
+			paths := make([]string, len(imports))
+			for i, imp := range imports {
+				paths[i] = imp.importPath
+			}
+			source, err := renderFile(pkgName, c, paths)
+			if err != nil {
+				return nil, fmt.Errorf("failed to format source, internal error: %s", err)
+			}
+			files = append(files, File{Suffix: c.suffix(), GOOS: c.goos, GOARCH: c.goarch, Source: source})
+		}
+		return files, nil
+	}
+
+	// --registry mode: verify every found subpackage exports a compatible
+	// factory before generating anything, so a broken plugin is reported
+	// clearly rather than producing code that fails to compile.
+	registryIface, err := registryTypeInterface(currentPkg, opts.Registry)
+	if err != nil {
+		return nil, fmt.Errorf("Registry=%s: %s", opts.Registry, err)
+	}
+	var offending []string
+	for _, imp := range found {
+		pkg, ok := loadPackage(imp.folder, imp.loadGOOS, imp.loadGOARCH, opts.Tags)
+		if !ok {
+			offending = append(offending, fmt.Sprintf("%s: failed to load package", imp.folder))
+			continue
+		}
+		if err := checkFactory(pkg, opts.Factory, registryIface); err != nil {
+			offending = append(offending, err.Error())
+		}
+	}
+	if len(offending) > 0 {
+		return nil, fmt.Errorf("subpackages incompatible with Registry=%s Factory=%s:\n%s",
+			opts.Registry, opts.Factory, strings.Join(offending, "\n"))
+	}
+
+	varName := opts.Registry + "s"
+	var files []File
+	for key, imports := range buckets {
+		c := bucketConstraint[key]
+		source, err := renderRegistryFile(pkgName, c, opts.Registry, varName, opts.Factory, registryEntries(imports))
+		if err != nil {
+			return nil, fmt.Errorf("failed to format source, internal error: %s", err)
+		}
+		files = append(files, File{Suffix: c.suffix(), GOOS: c.goos, GOARCH: c.goarch, Source: source})
+	}
+	return files, nil
+}
+
+// constrainedGOOS is the set of GOOS values a subpackage is checked against
+// to determine whether it's platform constrained. Not exhaustive, but covers
+// the platforms plugin subtrees are commonly constrained to.
+var constrainedGOOS = []string{
+	"linux", "darwin", "windows", "freebsd", "netbsd", "openbsd",
+	"android", "solaris", "dragonfly", "illumos", "plan9",
+}
+
+// constrainedGOARCH is the set of GOARCH values a subpackage is checked
+// against to determine whether it's architecture constrained. Not
+// exhaustive, but covers the architectures plugin subtrees are commonly
+// constrained to.
+var constrainedGOARCH = []string{
+	"amd64", "386", "arm64", "arm", "ppc64le", "mips64", "riscv64", "wasm",
+}
+
+// constraint is the GOOS/GOARCH subset a subpackage is restricted to. The
+// zero value means unconstrained: it builds under every combination this
+// package checks.
+type constraint struct {
+	goos   []string // sorted; nil if not GOOS-constrained
+	goarch []string // sorted; nil if not GOARCH-constrained
+}
+
+// key returns a string that's equal for two constraints iff they select the
+// same GOOS/GOARCH subset, suitable for use as a bucket map key.
+func (c constraint) key() string {
+	return strings.Join(c.goos, ",") + "|" + strings.Join(c.goarch, ",")
+}
+
+// suffix derives the File.Suffix for this constraint, e.g. goos=["windows"]
+// becomes "_windows", goarch=["arm64"] becomes "_arm64", and both together
+// become "_windows_arm64". The zero value returns "".
+func (c constraint) suffix() string {
+	if len(c.goos) == 0 && len(c.goarch) == 0 {
+		return ""
+	}
+	return "_" + strings.Join(append(append([]string{}, c.goos...), c.goarch...), "_")
+}
+
+// buildTag renders this constraint as a //go:build expression, e.g.
+// "(linux || darwin) && (arm64)". The zero value returns "".
+func (c constraint) buildTag() string {
+	var clauses []string
+	if len(c.goos) > 0 {
+		clauses = append(clauses, fmt.Sprintf("(%s)", strings.Join(c.goos, " || ")))
+	}
+	if len(c.goarch) > 0 {
+		clauses = append(clauses, fmt.Sprintf("(%s)", strings.Join(c.goarch, " || ")))
+	}
+	return strings.Join(clauses, " && ")
+}
+
+// currentGoMod returns the value of 'go env GOMOD' for dir, which is the
+// absolute path to the module's go.mod file, or the empty string if dir
+// isn't inside a module (GOPATH mode, or GO111MODULE=off).
+func currentGoMod(dir string) (string, error) {
+	cmd := exec.Command("go", "env", "GOMOD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run 'go env GOMOD': %s", err)
+	}
+	gomod := strings.TrimSpace(string(out))
+	if gomod == os.DevNull {
+		// Older Go versions print os.DevNull when outside of a module.
+		gomod = ""
+	}
+	return gomod, nil
+}
+
+// loadPackage resolves the package in dir, module-aware. ok is false if dir
+// doesn't contain a buildable package. goos/goarch, if non-empty, evaluate
+// dir under that GOOS/GOARCH instead of the host's, so platform-constrained
+// packages can still be resolved on another platform. tags mirrors
+// 'go build -tags'.
+func loadPackage(dir string, goos string, goarch string, tags []string) (pkg *packages.Package, ok bool) {
+	cfg := &packages.Config{
+		Dir: dir,
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedModule |
+			packages.NeedTypes | packages.NeedTypesInfo | packages.NeedSyntax | packages.NeedDeps,
+	}
+	env := os.Environ()
+	if goos != "" {
+		env = append(env, "GOOS="+goos)
+	}
+	if goarch != "" {
+		env = append(env, "GOARCH="+goarch)
+	}
+	if goos != "" || goarch != "" {
+		cfg.Env = env
+	}
+	if len(tags) > 0 {
+		cfg.BuildFlags = []string{"-tags", strings.Join(tags, ",")}
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil || len(pkgs) != 1 || pkgs[0].Name == "" || len(pkgs[0].Errors) > 0 {
+		return nil, false
+	}
+	return pkgs[0], true
+}
+
+// isNestedModule reports whether dir contains its own go.mod, i.e. it's the
+// root of a separate module nested inside the one we're generating from.
+func isNestedModule(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "go.mod"))
+	return err == nil
+}
+
+// alwaysSkip reports whether name is a folder the go tool itself would never
+// treat as part of a package tree, regardless of --include/--exclude.
+func alwaysSkip(name string) bool {
+	switch name {
+	case "vendor", "testdata", "node_modules":
+		return true
+	}
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// filters holds the --include/--exclude glob patterns used to decide whether
+// a subfolder, identified by its slash-separated path relative to the
+// top-level folder being scanned, should be considered.
+type filters struct {
+	include []string
+	exclude []string
+}
+
+// allowed reports whether relPath passes the filters: --exclude always wins,
+// and when any --include patterns were given, relPath must match one of them.
+func (f filters) allowed(relPath string) bool {
+	for _, pattern := range f.exclude {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// goosConstraint reports which of constrainedGOOS folder builds under, given
+// tags. unconstrained is true if folder builds under all of them, i.e. it's
+// not platform constrained; matched is then meaningless and should be
+// ignored. An empty, non-unconstrained matched means folder isn't buildable
+// for any of constrainedGOOS (e.g. it has no Go files at all).
+func platformConstraint(folder string, tags []string, logger *log.Logger) (c constraint, buildable bool) {
+	matched := map[[2]string]bool{}
+	for _, goos := range constrainedGOOS {
+		for _, goarch := range constrainedGOARCH {
+			ctx := build.Default
+			ctx.GOOS = goos
+			ctx.GOARCH = goarch
+			ctx.BuildTags = tags
+			if _, err := ctx.ImportDir(folder, 0); err == nil {
+				matched[[2]string{goos, goarch}] = true
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return constraint{}, false
+	}
+	if len(matched) == len(constrainedGOOS)*len(constrainedGOARCH) {
+		return constraint{}, true
+	}
+
+	goosSet := map[string]bool{}
+	goarchSet := map[string]bool{}
+	for pair := range matched {
+		goosSet[pair[0]] = true
+		goarchSet[pair[1]] = true
+	}
+
+	// The constraint is only expressible as independent GOOS/GOARCH lists
+	// ("(goos1 || goos2) && (goarch1 || goarch2)") if matched is exactly
+	// their cartesian product; otherwise report it as a precision loss
+	// rather than silently building a possibly-wrong //go:build expression.
+	rectangular := len(matched) == len(goosSet)*len(goarchSet)
+	if rectangular {
+		for goos := range goosSet {
+			for goarch := range goarchSet {
+				if !matched[[2]string{goos, goarch}] {
+					rectangular = false
+				}
+			}
+		}
+	}
+	if !rectangular {
+		logger.Printf("%s: build constraint isn't a simple GOOS/GOARCH combination, approximating as the union of matched GOOS values", folder)
+		for goos := range goosSet {
+			c.goos = append(c.goos, goos)
+		}
+		sort.Strings(c.goos)
+		return c, true
+	}
+
+	if len(goosSet) < len(constrainedGOOS) {
+		for goos := range goosSet {
+			c.goos = append(c.goos, goos)
+		}
+		sort.Strings(c.goos)
+	}
+	if len(goarchSet) < len(constrainedGOARCH) {
+		for goarch := range goarchSet {
+			c.goarch = append(c.goarch, goarch)
+		}
+		sort.Strings(c.goarch)
+	}
+	return c, true
+}
+
+// foundImport is a subpackage selected for import, together with the
+// GOOS/GOARCH values it's constrained to.
+type foundImport struct {
+	importPath string
+	folder     string
+	constraint constraint
+	loadGOOS   string // the GOOS loadPackage resolved importPath under, "" for the host's
+	loadGOARCH string // the GOARCH loadPackage resolved importPath under, "" for the host's
+}
+
+func findImports(importPath string, folder string, relPath string, recursive bool, useModules bool, f filters, tags []string, logger *log.Logger) []foundImport {
+	// List contents of folder
+	entries, err := ioutil.ReadDir(folder)
+	if err != nil {
+		logger.Printf("Couldn't list contents of folder: %s, error: %s", folder, err)
+		return nil
+	}
+
+	var found []foundImport
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		subFolder := filepath.Join(folder, name)
+		subRelPath := path.Join(relPath, name)
+
+		if alwaysSkip(name) {
+			continue
+		}
+		if !f.allowed(subRelPath) {
+			logger.Printf("Skipping %s: excluded by --include/--exclude", subFolder)
+			continue
+		}
+		if isNestedModule(subFolder) {
+			logger.Printf("Skipping %s: contains its own go.mod, it's a separate module", subFolder)
+			continue
+		}
+
+		c, buildable := platformConstraint(subFolder, tags, logger)
+
+		subImportPath := path.Join(importPath, name)
+		loadGOOS, loadGOARCH := "", ""
+		if buildable && useModules {
+			// Resolve under a GOOS/GOARCH the package actually builds for,
+			// so platform-constrained packages can be resolved even when
+			// the host platform isn't one of them.
+			if len(c.goos) > 0 {
+				loadGOOS = c.goos[0]
+			}
+			if len(c.goarch) > 0 {
+				loadGOARCH = c.goarch[0]
+			}
+			if resolved, ok := loadPackageImportPath(subFolder, loadGOOS, loadGOARCH, tags); ok {
+				subImportPath = resolved
+			} else {
+				buildable = false
+			}
+		}
+
+		if buildable {
+			switch {
+			case len(c.goos) > 0 && len(c.goarch) > 0:
+				logger.Printf("%s (constrained to: %s / %s)", subImportPath, strings.Join(c.goos, ", "), strings.Join(c.goarch, ", "))
+			case len(c.goos) > 0:
+				logger.Printf("%s (constrained to: %s)", subImportPath, strings.Join(c.goos, ", "))
+			case len(c.goarch) > 0:
+				logger.Printf("%s (constrained to: %s)", subImportPath, strings.Join(c.goarch, ", "))
+			default:
+				logger.Println(subImportPath)
+			}
+			found = append(found, foundImport{importPath: subImportPath, folder: subFolder, constraint: c, loadGOOS: loadGOOS, loadGOARCH: loadGOARCH})
+		} else {
+			logger.Printf("Not a buildable Go package, not importing: %s", subFolder)
+		}
+		if recursive {
+			// Even when subFolder itself isn't a package (e.g. it merely
+			// groups plugins in sub-packages), its children might be.
+			found = append(found, findImports(subImportPath, subFolder, subRelPath, recursive, useModules, f, tags, logger)...)
+		}
+	}
+	return found
+}
+
+// loadPackageImportPath resolves the real, module-aware import path of the
+// package in folder, rather than naively joining the parent import path with
+// the folder name (which breaks for nested modules and vendored trees). ok is
+// false if folder doesn't contain a buildable package. See loadPackage for
+// goos, goarch and tags.
+func loadPackageImportPath(folder string, goos string, goarch string, tags []string) (string, bool) {
+	pkg, ok := loadPackage(folder, goos, goarch, tags)
+	if !ok {
+		return "", false
+	}
+	return pkg.PkgPath, true
+}
+
+// renderFile generates the source of a single output file: a package clause,
+// an optional //go:build header for constrained buckets, and a blank import
+// for each path in imports.
+func renderFile(pkgName string, c constraint, imports []string) ([]byte, error) {
+	var b bytes.Buffer
+	if tag := c.buildTag(); tag != "" {
+		b.WriteString(fmt.Sprintf("//go:build %s\n\n", tag))
+	}
+	b.WriteString(fmt.Sprintf("package %s\n", pkgName))
+	for _, importPath := range imports {
+		b.WriteString(fmt.Sprintf("import _ \"%s\"\n", importPath))
+	}
+	return format.Source(b.Bytes())
+}
+
+// registryTypeInterface resolves the interface type named registryType,
+// declared in currentPkg, that --registry factories must implement.
+func registryTypeInterface(currentPkg *packages.Package, registryType string) (*types.Interface, error) {
+	obj := currentPkg.Types.Scope().Lookup(registryType)
+	if obj == nil {
+		return nil, fmt.Errorf("no such type %s in package %s", registryType, currentPkg.PkgPath)
+	}
+	tn, ok := obj.(*types.TypeName)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a type", registryType)
+	}
+	iface, ok := tn.Type().Underlying().(*types.Interface)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an interface type", registryType)
+	}
+	return iface, nil
+}
+
+// checkFactory reports an error unless pkg exports a zero-argument function
+// named factoryName whose return type implements iface.
+func checkFactory(pkg *packages.Package, factoryName string, iface *types.Interface) error {
+	obj := pkg.Types.Scope().Lookup(factoryName)
+	if obj == nil {
+		return fmt.Errorf("%s: does not export func %s", pkg.PkgPath, factoryName)
+	}
+	fn, ok := obj.(*types.Func)
+	if !ok {
+		return fmt.Errorf("%s: %s is not a function", pkg.PkgPath, factoryName)
+	}
+	sig := fn.Type().(*types.Signature)
+	if sig.Params().Len() != 0 || sig.Results().Len() != 1 {
+		return fmt.Errorf("%s: func %s must take no arguments and return exactly one value", pkg.PkgPath, factoryName)
+	}
+	if result := sig.Results().At(0).Type(); !types.Implements(result, iface) {
+		return fmt.Errorf("%s: return type %s of func %s doesn't implement the --registry type", pkg.PkgPath, result, factoryName)
+	}
+	return nil
+}
+
+// registryEntry is a subpackage that qualified for --registry: it's
+// imported under local alias and registered as map[key] = alias.factory().
+type registryEntry struct {
+	alias      string
+	key        string
+	importPath string
+}
+
+// registryEntries builds the import aliases and map keys for imports,
+// de-duplicating both the aliases and the keys synthesized from the last
+// component of each package's folder path; --recursive routinely selects two
+// subpackages with the same leaf directory name (e.g. plugins/a/foo and
+// plugins/b/foo), and leaving either collision unresolved produces a map
+// literal with a duplicate key, which fails to compile.
+//
+// The map key is a string literal, so the directory name is used verbatim
+// (e.g. "my-plugin" is a perfectly good map key). The import alias is a Go
+// identifier, so it's sanitized first: a plugin directory named with a
+// non-identifier style, most commonly kebab-case ("plugins/my-plugin"), would
+// otherwise generate an `import my-plugin "..."` that fails to parse.
+func registryEntries(imports []foundImport) []registryEntry {
+	seenAlias := map[string]int{}
+	seenKey := map[string]int{}
+	entries := make([]registryEntry, len(imports))
+	for i, imp := range imports {
+		name := filepath.Base(imp.folder)
+
+		sanitized := sanitizeIdent(name)
+		seenAlias[sanitized]++
+		alias := sanitized
+		if n := seenAlias[sanitized]; n > 1 {
+			alias = fmt.Sprintf("%s%d", sanitized, n)
+		}
+
+		seenKey[name]++
+		key := name
+		if n := seenKey[name]; n > 1 {
+			key = fmt.Sprintf("%s%d", name, n)
+		}
+
+		entries[i] = registryEntry{alias: alias, key: key, importPath: imp.importPath}
+	}
+	return entries
+}
+
+// sanitizeIdent turns name into a valid Go identifier: every rune that isn't
+// a letter, digit or underscore becomes an underscore, and an underscore is
+// prepended if the result would otherwise start with a digit (or be empty).
+func sanitizeIdent(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	ident := b.String()
+	if ident == "" || unicode.IsDigit(rune(ident[0])) {
+		ident = "_" + ident
+	}
+	return ident
+}
+
+// renderRegistryFile generates the source of a single --registry output
+// file: a package clause, an optional //go:build header, an import for each
+// entry under its synthesized alias, and a map[string]registryType variable
+// named varName populated by calling factoryName on each alias.
+func renderRegistryFile(pkgName string, c constraint, registryType string, varName string, factoryName string, entries []registryEntry) ([]byte, error) {
+	var b bytes.Buffer
+	if tag := c.buildTag(); tag != "" {
+		b.WriteString(fmt.Sprintf("//go:build %s\n\n", tag))
+	}
+	b.WriteString(fmt.Sprintf("package %s\n", pkgName))
+	for _, e := range entries {
+		b.WriteString(fmt.Sprintf("import %s \"%s\"\n", e.alias, e.importPath))
+	}
+	b.WriteString(fmt.Sprintf("var %s = map[string]%s{\n", varName, registryType))
+	for _, e := range entries {
+		b.WriteString(fmt.Sprintf("\"%s\": %s.%s(),\n", e.key, e.alias, factoryName))
+	}
+	b.WriteString("}\n")
+	return format.Source(b.Bytes())
+}
@@ -0,0 +1,289 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package subtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func discardLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// chdir switches the process working directory to dir for the duration of
+// the test, restoring it on cleanup.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(old); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRegistryEntriesDedupesAliasAndKey(t *testing.T) {
+	imports := []foundImport{
+		{importPath: "example.com/m/plugins/a/foo", folder: "/tmp/m/plugins/a/foo"},
+		{importPath: "example.com/m/plugins/b/foo", folder: "/tmp/m/plugins/b/foo"},
+	}
+	entries := registryEntries(imports)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if entries[0].alias == entries[1].alias {
+		t.Errorf("aliases not deduped: both %q", entries[0].alias)
+	}
+	if entries[0].key == entries[1].key {
+		t.Errorf("keys not deduped: both %q, would produce a duplicate map key", entries[0].key)
+	}
+}
+
+func TestRegistryEntriesSanitizesKebabCaseAlias(t *testing.T) {
+	imports := []foundImport{
+		{importPath: "example.com/m/plugins/my-plugin", folder: "/tmp/m/plugins/my-plugin"},
+	}
+	entries := registryEntries(imports)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if entries[0].alias != "my_plugin" {
+		t.Errorf("alias = %q, want a valid Go identifier (my_plugin)", entries[0].alias)
+	}
+	// The map key is a string literal, so it keeps the directory's own
+	// spelling rather than being mangled like the import alias.
+	if entries[0].key != "my-plugin" {
+		t.Errorf("key = %q, want unsanitized %q", entries[0].key, "my-plugin")
+	}
+}
+
+func TestConstraintBuildTagAndSuffix(t *testing.T) {
+	cases := []struct {
+		name       string
+		c          constraint
+		wantTag    string
+		wantSuffix string
+	}{
+		{"unconstrained", constraint{}, "", ""},
+		{"goos only", constraint{goos: []string{"darwin", "linux"}}, "(darwin || linux)", "_darwin_linux"},
+		{"goarch only", constraint{goarch: []string{"arm64"}}, "(arm64)", "_arm64"},
+		{"both", constraint{goos: []string{"windows"}, goarch: []string{"386", "amd64"}}, "(windows) && (386 || amd64)", "_windows_386_amd64"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.c.buildTag(); got != tc.wantTag {
+				t.Errorf("buildTag() = %q, want %q", got, tc.wantTag)
+			}
+			if got := tc.c.suffix(); got != tc.wantSuffix {
+				t.Errorf("suffix() = %q, want %q", got, tc.wantSuffix)
+			}
+		})
+	}
+}
+
+func TestPlatformConstraintGOARCHOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "p.go"), "//go:build arm64\n\npackage p\n")
+
+	c, buildable := platformConstraint(dir, nil, discardLogger())
+	if !buildable {
+		t.Fatal("expected an arm64-only package to be reported as buildable")
+	}
+	if len(c.goos) != 0 {
+		t.Errorf("goos = %v, want unconstrained (nil) for a GOARCH-only constraint", c.goos)
+	}
+	if got := c.goarch; len(got) != 1 || got[0] != "arm64" {
+		t.Errorf("goarch = %v, want [arm64]", got)
+	}
+}
+
+func TestPlatformConstraintGOOSOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "p.go"), "//go:build windows\n\npackage p\n")
+
+	c, buildable := platformConstraint(dir, nil, discardLogger())
+	if !buildable {
+		t.Fatal("expected a windows-only package to be reported as buildable")
+	}
+	if len(c.goarch) != 0 {
+		t.Errorf("goarch = %v, want unconstrained (nil) for a GOOS-only constraint", c.goarch)
+	}
+	if got := c.goos; len(got) != 1 || got[0] != "windows" {
+		t.Errorf("goos = %v, want [windows]", got)
+	}
+}
+
+func TestPlatformConstraintUnconstrained(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "p.go"), "package p\n")
+
+	c, buildable := platformConstraint(dir, nil, discardLogger())
+	if !buildable {
+		t.Fatal("expected a plain package to be reported as buildable")
+	}
+	if len(c.goos) != 0 || len(c.goarch) != 0 {
+		t.Errorf("got constraint %+v, want unconstrained", c)
+	}
+}
+
+// newModule lays out a minimal module on disk, rooted at a temp directory:
+// a go.mod, a main.go with the given content, and each of files written
+// relative to the module root.
+func newModule(t *testing.T, mainGo string, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "go.mod"), "module example.com/m\n\ngo 1.21\n")
+	writeFile(t, filepath.Join(dir, "main.go"), mainGo)
+	for name, content := range files {
+		writeFile(t, filepath.Join(dir, name), content)
+	}
+	return dir
+}
+
+func TestGenerateFilesBlankImports(t *testing.T) {
+	dir := newModule(t, "package main\n\nfunc main() {}\n", map[string]string{
+		"plugins/foo/foo.go": "package foo\n",
+		"plugins/bar/bar.go": "package bar\n",
+	})
+	chdir(t, dir)
+
+	files, err := GenerateFiles(Options{Folders: []string{"plugins"}, Logger: discardLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1 (no platform-constrained subpackages)", len(files))
+	}
+	src := string(files[0].Source)
+	for _, want := range []string{`import _ "example.com/m/plugins/bar"`, `import _ "example.com/m/plugins/foo"`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("output missing %q, got:\n%s", want, src)
+		}
+	}
+}
+
+// TestGenerateFilesRegistryKeysDontCollide reproduces the scenario from the
+// chunk0-4 review: two --recursive-selected subpackages sharing a leaf
+// directory name (plugins/a/foo and plugins/b/foo) must not produce a map
+// literal with a duplicate key, which fails to compile.
+func TestGenerateFilesRegistryKeysDontCollide(t *testing.T) {
+	plugin := func(pkg, label string) string {
+		return fmt.Sprintf("package %s\n\ntype p struct{}\n\nfunc (p) Name() string { return %q }\nfunc New() p { return p{} }\n", pkg, label)
+	}
+	dir := newModule(t, "package main\n\ntype Plugin interface{ Name() string }\n\nfunc main() {}\n", map[string]string{
+		"plugins/a/foo/foo.go": plugin("foo", "a/foo"),
+		"plugins/b/foo/foo.go": plugin("foo", "b/foo"),
+	})
+	chdir(t, dir)
+
+	files, err := GenerateFiles(Options{
+		Folders:   []string{"plugins"},
+		Recursive: true,
+		Registry:  "Plugin",
+		Factory:   "New",
+		Logger:    discardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+
+	buildGeneratedFile(t, dir, files[0].Source)
+}
+
+// TestGenerateFilesKebabCaseDirectory reproduces the chunk0-4 review
+// scenario: a perfectly valid plugin directory named in kebab-case, a
+// common CLI-plugin naming style, must not produce an unparsable
+// `import my-plugin "..."`.
+func TestGenerateFilesKebabCaseDirectory(t *testing.T) {
+	dir := newModule(t, "package main\n\ntype Plugin interface{ Name() string }\n\nfunc main() {}\n", map[string]string{
+		"plugins/my-plugin/p.go": "package myplugin\n\ntype p struct{}\n\nfunc (p) Name() string { return \"my-plugin\" }\nfunc New() p { return p{} }\n",
+	})
+	chdir(t, dir)
+
+	files, err := GenerateFiles(Options{
+		Folders:  []string{"plugins"},
+		Registry: "Plugin",
+		Factory:  "New",
+		Logger:   discardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+	if !strings.Contains(string(files[0].Source), `"my-plugin": my_plugin.New()`) {
+		t.Errorf("output missing sanitized alias with original key, got:\n%s", files[0].Source)
+	}
+
+	buildGeneratedFile(t, dir, files[0].Source)
+}
+
+func TestGenerateFilesGOARCHBucketing(t *testing.T) {
+	dir := newModule(t, "package main\n\nfunc main() {}\n", map[string]string{
+		"plugins/arm64only/p.go": "//go:build arm64\n\npackage arm64only\n",
+	})
+	chdir(t, dir)
+
+	files, err := GenerateFiles(Options{Folders: []string{"plugins"}, Logger: discardLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var arm64File *File
+	for i, f := range files {
+		if len(f.GOARCH) == 1 && f.GOARCH[0] == "arm64" {
+			arm64File = &files[i]
+		}
+	}
+	if arm64File == nil {
+		t.Fatalf("expected a GOARCH-constrained file for the arm64-only subpackage, got files: %+v", files)
+	}
+	if !strings.Contains(string(arm64File.Source), `import _ "example.com/m/plugins/arm64only"`) {
+		t.Errorf("arm64 bucket missing the import, got:\n%s", arm64File.Source)
+	}
+	if arm64File.Suffix != "_arm64" {
+		t.Errorf("Suffix = %q, want %q", arm64File.Suffix, "_arm64")
+	}
+}
+
+// buildGeneratedFile writes src into module dir as its own file and runs
+// 'go build' on the module, the same way a broken map literal was
+// confirmed to fail during review.
+func buildGeneratedFile(t *testing.T, dir string, src []byte) {
+	t.Helper()
+	writeFile(t, filepath.Join(dir, "subtree_imports.go"), string(src))
+	cmd := exec.Command("go", "build", "./...")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("generated file doesn't compile: %s\n%s", err, out)
+	}
+}